@@ -33,36 +33,237 @@
 package safefile
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
+// ErrAlreadyCommitted is returned by Commit, Abort or Write when the file
+// has already been committed. Close after Commit returns nil instead.
+var ErrAlreadyCommitted = errors.New("safefile: already committed")
+
+// ErrAlreadyClosed is returned by Commit, Close, Abort or Write when the
+// file has already been closed or aborted.
+var ErrAlreadyClosed = errors.New("safefile: already closed")
+
+// fileState tracks the lifecycle of a File so that Commit, Close and
+// Abort agree on which one of them gets to touch the underlying
+// *os.File, even when called concurrently from multiple goroutines.
+type fileState int
+
+const (
+	stateOpen fileState = iota
+	stateCommitted
+	stateClosed
+	stateRenameFailed
+)
+
 type File struct {
 	*os.File
 	origName  string
-	closeFunc func(*File) error
+	finalName string
+
+	// dirSync, backupSuffix and versionedBackup are the Commit defaults
+	// established at Create time; Commit uses them unless overridden by
+	// the corresponding option passed directly to Commit.
+	dirSync         bool
+	backupSuffix    string
+	versionedBackup int
+
+	mu    sync.Mutex
+	state fileState
 }
 
-func makeTempName(origname string, counter int) (tempname string, err error) {
-	origname = filepath.Clean(origname)
-	if len(origname) == 0 || origname[len(origname)-1] == filepath.Separator {
+// maxSymlinkHops bounds symlink dereferencing in resolveFinalName so that
+// a symlink loop results in an error instead of an infinite loop.
+const maxSymlinkHops = 16
+
+func makeTempName(dir string, counter int) (tempname string, err error) {
+	if len(dir) == 0 {
 		return "", os.ErrInvalid
 	}
-	return filepath.Join(filepath.Dir(origname), fmt.Sprintf("%x-%d.tmp", time.Now().UnixNano(), counter)), nil
+	return filepath.Join(dir, fmt.Sprintf("%x-%d.tmp", time.Now().UnixNano(), counter)), nil
 }
 
-// Create creates a file in the same directory as filename
-func Create(filename string, perm os.FileMode) (*File, error) {
+// makeRandomTempName returns a temp name in dir with a crypto/rand-derived
+// suffix, so that concurrent processes creating files in the same
+// directory cannot guess, and thus collide on, each other's temp name.
+func makeRandomTempName(dir string) (tempname string, err error) {
+	if len(dir) == 0 {
+		return "", os.ErrInvalid
+	}
+	var suffix [16]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.tmp", suffix)), nil
+}
+
+// resolveFinalName follows filename if it is a symlink (or a chain of
+// symlinks), returning the path of the final, non-symlink file that
+// Commit should actually replace. If filename does not exist, or is not
+// a symlink, it is returned unchanged.
+func resolveFinalName(filename string) (string, error) {
+	name := filename
+	for i := 0; i < maxSymlinkHops; i++ {
+		fi, err := os.Lstat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return name, nil
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return name, nil
+		}
+		target, err := os.Readlink(name)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = filepath.Clean(target)
+	}
+	return "", fmt.Errorf("safefile: too many levels of symbolic links: %s", filename)
+}
+
+// options holds the resolved configuration built up by Option values. It
+// is shared between CreateWithOptions (which uses all fields) and Commit
+// (which only looks at dirSync, backupSuffix and versionedBackup), so that
+// a single Option type, such as WithDirSync, can be passed to either.
+type options struct {
+	tempDir         string
+	perm            os.FileMode
+	inheritMode     bool
+	symlinkDeref    bool
+	dirSync         bool
+	randomName      bool
+	backupSuffix    string
+	versionedBackup int
+}
+
+// Option configures CreateWithOptions or Commit.
+type Option func(*options)
+
+// WithTempDir makes CreateWithOptions create the temporary file in dir
+// instead of next to the target file. dir must be on the same filesystem
+// as the target's directory, since Commit renames the temporary file into
+// place and a cross-device rename cannot be atomic; CreateWithOptions
+// returns an error up front if it detects otherwise.
+func WithTempDir(dir string) Option {
+	return func(o *options) {
+		o.tempDir = dir
+	}
+}
+
+// WithFileMode sets the permissions to use for a newly created temporary
+// file. It is overridden by mode inheritance from an existing target
+// file unless combined with WithInheritMode(false).
+func WithFileMode(perm os.FileMode) Option {
+	return func(o *options) {
+		o.perm = perm
+	}
+}
+
+// WithInheritMode controls whether the temporary file inherits its mode
+// from an existing file at the target path (the default), as opposed to
+// always using the mode given to WithFileMode/Create.
+func WithInheritMode(inherit bool) Option {
+	return func(o *options) {
+		o.inheritMode = inherit
+	}
+}
+
+// WithSymlinkDeref controls whether CreateWithOptions follows symlinks at
+// the target path (the default, matching Create), as opposed to treating
+// the target path itself as the file to replace (matching CreateNoDeref).
+func WithSymlinkDeref(deref bool) Option {
+	return func(o *options) {
+		o.symlinkDeref = deref
+	}
+}
+
+// WithRandomName makes CreateWithOptions derive the temporary file's name
+// from crypto/rand instead of a timestamp and counter, and open it with
+// O_EXCL, so that concurrent processes creating files in the same
+// directory cannot collide on a predictable temp name.
+func WithRandomName(random bool) Option {
+	return func(o *options) {
+		o.randomName = random
+	}
+}
+
+// CreateWithOptions creates a file for later Commit to filename, as
+// Create does, but lets callers opt into the optional behaviors
+// documented on WithTempDir, WithFileMode, WithInheritMode, WithDirSync,
+// WithSymlinkDeref and WithRandomName. Create is a thin wrapper over
+// CreateWithOptions using its defaults.
+func CreateWithOptions(filename string, opts ...Option) (*File, error) {
+	cfg := options{
+		inheritMode:  true,
+		symlinkDeref: true,
+		dirSync:      true,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	finalName := filename
+	if cfg.symlinkDeref {
+		var err error
+		finalName, err = resolveFinalName(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	finalName = filepath.Clean(finalName)
+	if len(finalName) == 0 || finalName[len(finalName)-1] == filepath.Separator {
+		return nil, os.ErrInvalid
+	}
+
+	// Lstat, not Stat: when symlinkDeref is true, finalName has already
+	// been fully resolved by resolveFinalName and is never itself a
+	// symlink, so Lstat and Stat agree. When symlinkDeref is false,
+	// finalName may still be a symlink, and the file actually being
+	// replaced by Commit is that symlink itself, not whatever it happens
+	// to point to. A symlink's own mode isn't a meaningful permission to
+	// inherit, so it's treated the same as finalName not existing: perm
+	// is used as given.
+	fi, statErr := os.Lstat(finalName)
+	inheritable := statErr == nil && fi.Mode()&os.ModeSymlink == 0
+	perm := cfg.perm
+	if inheritable && cfg.inheritMode {
+		perm = fi.Mode().Perm()
+	}
+
+	tempDir := cfg.tempDir
+	if tempDir == "" {
+		tempDir = filepath.Dir(finalName)
+	} else if same, err := sameFilesystem(tempDir, filepath.Dir(finalName)); err != nil {
+		return nil, err
+	} else if !same {
+		return nil, fmt.Errorf("safefile: temp dir %s is not on the same filesystem as %s", tempDir, finalName)
+	}
+
 	counter := 0
 	for {
-		tempname, err := makeTempName(filename, counter)
+		var tempname string
+		var err error
+		if cfg.randomName {
+			tempname, err = makeRandomTempName(tempDir)
+		} else {
+			tempname, err = makeTempName(tempDir, counter)
+		}
 		if err != nil {
 			return nil, err
 		}
-		f, err := os.OpenFile(tempname, os.O_RDWR|os.O_CREATE, perm)
+		f, err := os.OpenFile(tempname, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
 		if err != nil {
 			if os.IsExist(err) {
 				counter++
@@ -70,48 +271,193 @@ func Create(filename string, perm os.FileMode) (*File, error) {
 			}
 			return nil, err
 		}
+		if inheritable {
+			// Best-effort: not all platforms/filesystems support
+			// changing ownership, and callers typically aren't root.
+			_ = inheritOwnership(f, fi)
+		}
 		return &File{
-			File:      f,
-			origName:  filename,
-			closeFunc: closeUncommitted,
+			File:            f,
+			origName:        filename,
+			finalName:       finalName,
+			dirSync:         cfg.dirSync,
+			backupSuffix:    cfg.backupSuffix,
+			versionedBackup: cfg.versionedBackup,
 		}, nil
 	}
 }
 
+// Create creates a file in the same directory as the file that filename
+// resolves to, following symlinks (up to 16 hops) if filename is itself a
+// symlink or a chain of them. If a file already exists at the resolved
+// path, the temporary file inherits its mode and, where possible, its
+// owner and group; otherwise perm is used. Use CreateNoDeref to instead
+// replace a symlink at filename rather than its target.
+func Create(filename string, perm os.FileMode) (*File, error) {
+	return CreateWithOptions(filename, WithFileMode(perm))
+}
+
+// CreateNoDeref creates a file in the same directory as filename, without
+// following symlinks: if filename is a symlink, Commit will replace the
+// symlink itself rather than the file it points to.
+func CreateNoDeref(filename string, perm os.FileMode) (*File, error) {
+	return CreateWithOptions(filename, WithFileMode(perm), WithSymlinkDeref(false))
+}
+
 // OrigName returns the original filename given to Create.
 func (f *File) OrigName() string {
 	return f.origName
 }
 
-// Close closes temporary file and removes it.
-// If the file has been committed, Close is noop.
+// FinalName returns the path that Commit will actually rename the
+// temporary file to: filename itself, or, if filename was a symlink (or a
+// chain of symlinks) and the file was created with Create rather than
+// CreateNoDeref, the file it ultimately points to.
+func (f *File) FinalName() string {
+	return f.finalName
+}
+
+// Write writes to the temporary file. It returns ErrAlreadyCommitted or
+// ErrAlreadyClosed if the file has already been committed, closed,
+// aborted, or left closed by a failed Commit, instead of operating on
+// the (possibly already reused) closed underlying *os.File.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch f.state {
+	case stateCommitted:
+		return 0, ErrAlreadyCommitted
+	case stateClosed, stateRenameFailed:
+		return 0, ErrAlreadyClosed
+	}
+	return f.File.Write(p)
+}
+
+// Close closes the temporary file and removes it.
+// If the file has already been committed, Close is a noop. If the file
+// has already been closed or aborted, Close returns ErrAlreadyClosed.
 func (f *File) Close() error {
-	return f.closeFunc(f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch f.state {
+	case stateCommitted:
+		return nil
+	case stateClosed:
+		return ErrAlreadyClosed
+	}
+	var err0 error
+	if f.state == stateOpen {
+		err0 = f.File.Close()
+	}
+	err1 := os.Remove(f.Name())
+	f.state = stateClosed
+	if err0 != nil {
+		return err0
+	}
+	return err1
 }
 
-func closeUncommitted(f *File) error {
-	err0 := f.File.Close()
+// Abort discards the temporary file without committing it, expressing
+// the caller's intent explicitly instead of relying on a deferred Close
+// to notice the file was never committed. It is equivalent to Close,
+// except that it also returns ErrAlreadyCommitted if the file has
+// already been committed, rather than silently doing nothing.
+func (f *File) Abort() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state == stateCommitted {
+		return ErrAlreadyCommitted
+	}
+	switch f.state {
+	case stateClosed:
+		return ErrAlreadyClosed
+	}
+	var err0 error
+	if f.state == stateOpen {
+		err0 = f.File.Close()
+	}
 	err1 := os.Remove(f.Name())
-	f.closeFunc = closeAgainError
+	f.state = stateClosed
 	if err0 != nil {
 		return err0
 	}
 	return err1
 }
 
-func closeAfterFailedRename(f *File) error {
-	// just remove temporary file.
-	f.closeFunc = closeAgainError
-	return os.Remove(f.Name())
+// WithDirSync controls whether Commit fsyncs the directory containing the
+// file after renaming (enabled by default). Passed to CreateWithOptions,
+// it sets the default for every later call to Commit on that File;
+// passed directly to Commit, it overrides that default for the one call.
+// Callers committing many files into the same directory in a batch may
+// pass WithDirSync(false) and fsync the directory themselves once after
+// the batch instead.
+func WithDirSync(sync bool) Option {
+	return func(o *options) {
+		o.dirSync = sync
+	}
 }
 
-func closeCommitted(f *File) error {
-	// noop
+// WithBackup makes Commit preserve the file it replaces by renaming it to
+// finalName+suffix (e.g. ".bak") immediately before promoting the
+// temporary file, instead of simply overwriting it. Like WithDirSync, it
+// can be passed to CreateWithOptions/WriteFile to set the default for
+// Commit, or to Commit itself for one call. It is mutually exclusive
+// with WithVersionedBackup; whichever is passed last wins.
+func WithBackup(suffix string) Option {
+	return func(o *options) {
+		o.backupSuffix = suffix
+		o.versionedBackup = 0
+	}
+}
+
+// WithVersionedBackup makes Commit keep up to n rotating backups of the
+// file it replaces: before promoting the temporary file, finalName.1 is
+// renamed to finalName.2, finalName.2 to finalName.3, and so on up to
+// finalName.n (whose previous contents are discarded), and finally the
+// current finalName is renamed to finalName.1. It is mutually exclusive
+// with WithBackup; whichever is passed last wins.
+func WithVersionedBackup(n int) Option {
+	return func(o *options) {
+		o.versionedBackup = n
+		o.backupSuffix = ""
+	}
+}
+
+// rotateVersionedBackups shifts finalName.1..finalName.n-1 up to
+// finalName.2..finalName.n, discarding whatever was at finalName.n, so
+// that finalName.1 is free for the current file to be promoted into.
+func rotateVersionedBackups(finalName string, n int) error {
+	for i := n; i >= 2; i-- {
+		src := fmt.Sprintf("%s.%d", finalName, i-1)
+		dst := fmt.Sprintf("%s.%d", finalName, i)
+		if _, err := os.Lstat(src); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func closeAgainError(f *File) error {
-	return os.ErrInvalid
+// backupPath returns the path Commit should rename an existing finalName
+// to before promoting the temporary file, given cfg, or "" if no backup
+// was requested.
+func backupPath(finalName string, cfg *options) (string, error) {
+	switch {
+	case cfg.versionedBackup > 0:
+		if err := rotateVersionedBackups(finalName, cfg.versionedBackup); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s.1", finalName), nil
+	case cfg.backupSuffix != "":
+		return finalName + cfg.backupSuffix, nil
+	default:
+		return "", nil
+	}
 }
 
 // Commit safely closes the file by syncing temporary file,
@@ -124,7 +470,38 @@ func closeAgainError(f *File) error {
 // In case of error, the temporary file is still opened
 // and exists on disk; it must be closed by callers by
 // calling Close or by trying to commit again.
-func (f *File) Commit() error {
+//
+// After a successful rename, Commit also fsyncs the directory containing
+// the file, so that the rename itself survives a crash (on some
+// filesystems a rename is not durable until its directory is synced).
+// Pass WithDirSync(false) to skip this and batch it yourself; any error
+// from it is returned even though the rename has already succeeded.
+//
+// With WithBackup or WithVersionedBackup, Commit renames any file
+// already at the target path out of the way immediately before promoting
+// the temporary file, rather than overwriting it; if the promotion then
+// fails, Commit restores the backup before returning the error.
+//
+// Commit returns ErrAlreadyCommitted or ErrAlreadyClosed if the file has
+// already been committed, closed or aborted.
+func (f *File) Commit(opts ...Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch f.state {
+	case stateCommitted:
+		return ErrAlreadyCommitted
+	case stateClosed:
+		return ErrAlreadyClosed
+	}
+
+	cfg := options{
+		dirSync:         f.dirSync,
+		backupSuffix:    f.backupSuffix,
+		versionedBackup: f.versionedBackup,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	// Sync to disk.
 	err := f.Sync()
 	if err != nil {
@@ -135,19 +512,47 @@ func (f *File) Commit() error {
 	if err != nil {
 		return err
 	}
+	// Move any existing file out of the way before promoting the
+	// temporary file over it.
+	backup, err := backupPath(f.finalName, &cfg)
+	if err != nil {
+		f.state = stateRenameFailed
+		return err
+	}
+	backedUp := false
+	if backup != "" {
+		if err := os.Rename(f.finalName, backup); err != nil {
+			if !os.IsNotExist(err) {
+				f.state = stateRenameFailed
+				return err
+			}
+		} else {
+			backedUp = true
+		}
+	}
 	// Rename.
-	err = os.Rename(f.Name(), f.origName)
+	err = os.Rename(f.Name(), f.finalName)
 	if err != nil {
-		f.closeFunc = closeAfterFailedRename
+		if backedUp {
+			// Best-effort: restore the file we just moved aside.
+			os.Rename(backup, f.finalName)
+		}
+		f.state = stateRenameFailed
 		return err
 	}
-	f.closeFunc = closeCommitted
+	f.state = stateCommitted
+	if cfg.dirSync {
+		return syncDir(filepath.Dir(f.finalName))
+	}
 	return nil
 }
 
-// WriteFile is a safe analog of ioutil.WriteFile.
-func WriteFile(filename string, data []byte, perm os.FileMode) error {
-	f, err := Create(filename, perm)
+// WriteFile is a safe analog of ioutil.WriteFile. opts is forwarded to
+// CreateWithOptions and then again to Commit, so every Option — temp dir,
+// mode inheritance, symlink handling, random names, directory fsync,
+// backups — applies the same way it would to a manual Create+Commit.
+func WriteFile(filename string, data []byte, perm os.FileMode, opts ...Option) error {
+	f, err := CreateWithOptions(filename, append([]Option{WithFileMode(perm)}, opts...)...)
 	if err != nil {
 		return err
 	}
@@ -160,5 +565,5 @@ func WriteFile(filename string, data []byte, perm os.FileMode) error {
 		err = io.ErrShortWrite
 		return err
 	}
-	return f.Commit()
+	return f.Commit(opts...)
 }
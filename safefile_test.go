@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -116,3 +117,397 @@ func TestDoubleCommit(t *testing.T) {
 	}
 	os.Remove(name)
 }
+
+func TestSymlinkDeref(t *testing.T) {
+	target := tempFileName(4)
+	defer os.Remove(target)
+	if err := ioutil.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	link := tempFileName(5)
+	defer os.Remove(link)
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	f, err := Create(link, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if f.OrigName() != link {
+		t.Fatalf("OrigName %q differs from link %q", f.OrigName(), link)
+	}
+	if f.FinalName() != target {
+		t.Fatalf("FinalName %q differs from symlink target %q", f.FinalName(), target)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("link %q was replaced instead of its target", link)
+	}
+	if err := ensureFileContains(target, testData); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestCreateNoDeref(t *testing.T) {
+	target := tempFileName(6)
+	defer os.Remove(target)
+	if err := ioutil.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	link := tempFileName(7)
+	defer os.Remove(link)
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	f, err := CreateNoDeref(link, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if f.FinalName() != link {
+		t.Fatalf("FinalName %q differs from link %q", f.FinalName(), link)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+
+	fi, err := os.Lstat(link)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		t.Fatalf("link %q was not replaced", link)
+	}
+	if fi.Mode().Perm() == 0600 {
+		t.Fatalf("mode %v leaked the symlink target's 0600 mode instead of using the requested 0666", fi.Mode().Perm())
+	}
+	if err := ensureFileContains(link, testData); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ensureFileContains(target, "old"); err != nil {
+		t.Fatalf("symlink target was modified: %s", err)
+	}
+	os.Remove(link)
+}
+
+func TestCommitDirSync(t *testing.T) {
+	name := tempFileName(9)
+	defer os.Remove(name)
+	f, err := Create(name, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("default dir sync: %s", err)
+	}
+	if err := ensureFileContains(name, testData); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestCommitWithDirSyncDisabled(t *testing.T) {
+	name := tempFileName(10)
+	defer os.Remove(name)
+	f, err := Create(name, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(WithDirSync(false)); err != nil {
+		f.Close()
+		t.Fatalf("WithDirSync(false): %s", err)
+	}
+	if err := ensureFileContains(name, testData); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	name := tempFileName(11)
+	f, err := Create(name, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tempName := f.Name()
+	if err := f.Abort(); err != nil {
+		t.Fatalf("Abort failed: %s", err)
+	}
+	if _, err := os.Stat(tempName); err == nil || !os.IsNotExist(err) {
+		t.Fatalf("temp file %q still exists after Abort", tempName)
+	}
+	if err := f.Abort(); err != ErrAlreadyClosed {
+		t.Fatalf("second Abort returned %v, want ErrAlreadyClosed", err)
+	}
+}
+
+func TestAbortAfterCommit(t *testing.T) {
+	name := tempFileName(12)
+	defer os.Remove(name)
+	f, err := Create(name, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Abort(); err != ErrAlreadyCommitted {
+		t.Fatalf("Abort after commit returned %v, want ErrAlreadyCommitted", err)
+	}
+}
+
+func TestWriteAfterFailedCommit(t *testing.T) {
+	// Renaming the temp file over a directory fails deterministically,
+	// giving us a reliable way to exercise the rename-failed state.
+	dirAsTarget := tempFileName(13)
+	if err := os.Mkdir(dirAsTarget, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dirAsTarget)
+
+	f, err := Create(dirAsTarget, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err == nil {
+		f.Close()
+		t.Fatalf("Commit over a directory unexpectedly succeeded")
+	}
+	// Commit already closed the underlying *os.File before the failed
+	// rename; Write must report that instead of hitting it directly.
+	if _, err := f.Write([]byte("x")); err != ErrAlreadyClosed {
+		t.Fatalf("Write after failed commit returned %v, want ErrAlreadyClosed", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close after failed commit: %s", err)
+	}
+}
+
+func TestConcurrentCommitClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		name := tempFileName(100 + i)
+		f, err := Create(name, 0666)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if _, err := io.WriteString(f, testData); err != nil {
+			f.Close()
+			t.Fatalf("%s", err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); f.Commit() }()
+		go func() { defer wg.Done(); f.Close() }()
+		wg.Wait()
+
+		// Whichever of Commit/Close wins the race, the result must be
+		// well-defined: either the file was never committed, or it was
+		// committed with its full, uncorrupted contents. It must never
+		// be partially written or garbled.
+		b, err := ioutil.ReadFile(name)
+		switch {
+		case err == nil && string(b) != testData:
+			t.Fatalf("committed file has corrupt contents: %q", b)
+		case err != nil && !os.IsNotExist(err):
+			t.Fatalf("unexpected error reading %q: %s", name, err)
+		}
+		os.Remove(name)
+	}
+}
+
+func TestModeInherit(t *testing.T) {
+	name := tempFileName(8)
+	defer os.Remove(name)
+	if err := ioutil.WriteFile(name, []byte("old"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	f, err := Create(name, 0666)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("mode %v was not inherited from existing file (want 0600)", fi.Mode().Perm())
+	}
+}
+
+func TestCreateWithOptionsInheritModeFalse(t *testing.T) {
+	name := tempFileName(200)
+	defer os.Remove(name)
+	if err := ioutil.WriteFile(name, []byte("old"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	f, err := CreateWithOptions(name, WithFileMode(0644), WithInheritMode(false))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Fatalf("mode %v, want 0644 (WithInheritMode(false) should ignore the existing 0600)", fi.Mode().Perm())
+	}
+}
+
+func TestCreateWithOptionsRandomName(t *testing.T) {
+	name := tempFileName(201)
+	defer os.Remove(name)
+
+	f, err := CreateWithOptions(name, WithFileMode(0666), WithRandomName(true))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if filepath.Dir(f.Name()) != filepath.Dir(name) {
+		t.Fatalf("temp file %q not created next to %q", f.Name(), name)
+	}
+	if _, err := io.WriteString(f, testData); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := f.Commit(); err != nil {
+		f.Close()
+		t.Fatalf("%s", err)
+	}
+	if err := ensureFileContains(name, testData); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestCreateWithOptionsSymlinkDerefFalse(t *testing.T) {
+	target := tempFileName(202)
+	defer os.Remove(target)
+	if err := ioutil.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	link := tempFileName(203)
+	defer os.Remove(link)
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	f, err := CreateWithOptions(link, WithFileMode(0666), WithSymlinkDeref(false))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if f.FinalName() != link {
+		t.Fatalf("FinalName %q, want %q (WithSymlinkDeref(false) should not follow the link)", f.FinalName(), link)
+	}
+	f.Close()
+}
+
+func TestCreateWithOptionsTempDirCrossDevice(t *testing.T) {
+	if _, err := os.Stat("/proc/self"); err != nil {
+		t.Skip("no /proc filesystem available to use as a distinct device")
+	}
+	name := tempFileName(204)
+	if _, err := CreateWithOptions(name, WithTempDir("/proc")); err == nil {
+		t.Fatalf("expected an error using a temp dir on a different filesystem")
+	}
+}
+
+func TestWriteFileForwardsCreateOptions(t *testing.T) {
+	name := tempFileName(205)
+	defer os.Remove(name)
+	if err := WriteFile(name, []byte(testData), 0666, WithRandomName(true)); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ensureFileContains(name, testData); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestWithBackup(t *testing.T) {
+	name := tempFileName(300)
+	defer os.Remove(name)
+	defer os.Remove(name + ".bak")
+
+	if err := WriteFile(name, []byte("v1"), 0666); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := WriteFile(name, []byte("v2"), 0666, WithBackup(".bak")); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ensureFileContains(name, "v2"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ensureFileContains(name+".bak", "v1"); err != nil {
+		t.Fatalf("backup: %s", err)
+	}
+}
+
+func TestWithVersionedBackup(t *testing.T) {
+	name := tempFileName(301)
+	defer os.Remove(name)
+	defer os.Remove(name + ".1")
+	defer os.Remove(name + ".2")
+
+	for _, v := range []string{"a", "b", "c", "d"} {
+		if err := WriteFile(name, []byte(v), 0666, WithVersionedBackup(2)); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if err := ensureFileContains(name, "d"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ensureFileContains(name+".1", "c"); err != nil {
+		t.Fatalf(".1: %s", err)
+	}
+	if err := ensureFileContains(name+".2", "b"); err != nil {
+		t.Fatalf(".2: %s", err)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2013 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package safefile
+
+import (
+	"os"
+	"syscall"
+)
+
+// inheritOwnership changes the owner and group of f to match fi, which
+// describes an existing file being replaced. Errors (e.g. insufficient
+// permissions to chown) are returned to the caller, who is expected to
+// treat them as best-effort.
+func inheritOwnership(f *os.File, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+// sameFilesystem reports whether a and b live on the same filesystem, so
+// that a caller-supplied temp dir can be checked up front for a rename
+// that would otherwise fail with "invalid cross-device link".
+func sameFilesystem(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	sta, ok := fa.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true, nil
+	}
+	stb, ok := fb.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true, nil
+	}
+	return sta.Dev == stb.Dev, nil
+}
+
+// syncDir opens dir and fsyncs it, so that a preceding rename within it is
+// durable against a crash, then closes it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,34 @@
+// Copyright 2013 Dmitry Chestnykh. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package safefile
+
+import "os"
+
+// inheritOwnership is a no-op on Windows, which has no POSIX uid/gid
+// concept to inherit.
+func inheritOwnership(f *os.File, fi os.FileInfo) error {
+	return nil
+}
+
+// sameFilesystem always reports true on Windows: determining whether two
+// paths share a volume cheaply isn't worth it here, since a cross-device
+// rename will simply fail at Commit time with a clear error instead.
+func sameFilesystem(a, b string) (bool, error) {
+	return true, nil
+}
+
+// syncDir is a no-op on Windows. Opening a directory with os.Open and
+// fsyncing it, as the unix implementation does, is not reliably supported
+// there (FlushFileBuffers on a directory handle typically fails), and
+// MoveFileEx-based renames don't depend on a directory fsync for
+// durability the way POSIX rename does. Returning nil keeps the default
+// dirSync behavior from turning every Commit/WriteFile into an error on
+// this platform.
+func syncDir(dir string) error {
+	return nil
+}